@@ -0,0 +1,340 @@
+package tokencounter
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BudgetConfig enables token budget / rate-limit enforcement: whenever any
+// of its three limits is set, requests are rejected with 429 before being forwarded if the
+// pre-count plus the rolling window's usage would exceed the configured
+// limit.
+type BudgetConfig struct {
+	MaxTokensPerMinute int `json:"maxTokensPerMinute,omitempty"`
+	MaxTokensPerDay    int `json:"maxTokensPerDay,omitempty"`
+	MaxRequestTokens   int `json:"maxRequestTokens,omitempty"`
+	// KeyExtractor picks the identity a budget is tracked against: one of
+	// "user_field" (the request's "user" field), "header:<name>", or
+	// "remote_ip" (the default).
+	KeyExtractor string `json:"keyExtractor,omitempty"`
+	// RedisAddr, when set, backs the budget with Redis instead of the
+	// in-process store so counts stay consistent across a Traefik cluster.
+	RedisAddr string `json:"redisAddr,omitempty"`
+}
+
+// enabled reports whether any budget limit was configured.
+func (b BudgetConfig) enabled() bool {
+	return b.MaxTokensPerMinute > 0 || b.MaxTokensPerDay > 0 || b.MaxRequestTokens > 0
+}
+
+// Store tracks a rolling count of tokens spent per key. Incr adds n to
+// key's counter, creating it with the given window if absent. If max is
+// greater than zero and the result would exceed it, the increment is not
+// committed: allowed is false and used reports the counter's unchanged
+// current total. Passing max as zero always commits, which callers use to
+// record tokens for a request that was already allowed through.
+type Store interface {
+	Incr(key string, n int, window time.Duration, max int) (used int, allowed bool, err error)
+}
+
+// extractKey derives the identity a request's token usage is billed
+// against, falling back to the client's remote IP when the configured
+// extractor has nothing to read.
+func extractKey(cfg BudgetConfig, req *http.Request, user string) string {
+	switch {
+	case cfg.KeyExtractor == "user_field":
+		if user != "" {
+			return user
+		}
+	case strings.HasPrefix(cfg.KeyExtractor, "header:"):
+		if v := req.Header.Get(strings.TrimPrefix(cfg.KeyExtractor, "header:")); v != "" {
+			return v
+		}
+	}
+	return remoteIP(req)
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// memoryCounter is a single key's fixed-window counter: its count resets to
+// zero once resetAt passes, and usage from the previous window is not
+// carried over.
+type memoryCounter struct {
+	mu      sync.Mutex
+	used    int
+	resetAt time.Time
+}
+
+const memoryStoreShards = 16
+
+// memoryStore is a sharded, in-process Store suitable for a single Traefik
+// instance. Sharding by key hash keeps lock contention local to a shard
+// instead of a single map.
+type memoryStore struct {
+	shards [memoryStoreShards]sync.Map
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+func (s *memoryStore) shardFor(key string) *sync.Map {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &s.shards[h.Sum32()%memoryStoreShards]
+}
+
+func (s *memoryStore) Incr(key string, n int, window time.Duration, max int) (int, bool, error) {
+	shard := s.shardFor(key)
+	now := time.Now()
+
+	v, _ := shard.LoadOrStore(key, &memoryCounter{resetAt: now.Add(window)})
+	counter := v.(*memoryCounter)
+
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if now.After(counter.resetAt) {
+		counter.used = 0
+		counter.resetAt = now.Add(window)
+	}
+	if max > 0 && counter.used+n > max {
+		return counter.used, false, nil
+	}
+	counter.used += n
+	return counter.used, true, nil
+}
+
+// budgetIncrScript atomically checks a counter against max before
+// committing the increment, so a rejected request never inflates the
+// window, and sets the key's expiry the first time it's created so the
+// window rolls off on its own. It returns a two-element array: the
+// counter's resulting (or unchanged) value, and 1 if the increment
+// committed or 0 if it was refused.
+const budgetIncrScript = `
+local used = tonumber(redis.call("GET", KEYS[1]) or "0")
+local n = tonumber(ARGV[1])
+local max = tonumber(ARGV[3])
+if max > 0 and used + n > max then
+  return {used, 0}
+end
+used = redis.call("INCRBY", KEYS[1], n)
+if tonumber(redis.call("PTTL", KEYS[1])) < 0 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return {used, 1}
+`
+
+// redisStore is a Store backed by Redis so counts stay consistent across a
+// cluster of Traefik instances. It speaks just enough of the RESP protocol
+// by hand to run one EVAL command, since Traefik's Yaegi interpreter can't
+// load a full Redis client dependency.
+type redisStore struct {
+	addr string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisStore(addr string) *redisStore {
+	return &redisStore{addr: addr}
+}
+
+func (s *redisStore) Incr(key string, n int, window time.Duration, max int) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn, err := s.connLocked()
+	if err != nil {
+		return 0, false, err
+	}
+
+	cmd := encodeRESPCommand("EVAL", budgetIncrScript, "1", key, strconv.Itoa(n), strconv.Itoa(int(window/time.Millisecond)), strconv.Itoa(max))
+	if _, err := conn.Write(cmd); err != nil {
+		s.resetLocked()
+		return 0, false, fmt.Errorf("tokencounter: writing to redis: %w", err)
+	}
+
+	used, allowed, err := readRESPIntPair(s.reader)
+	if err != nil {
+		s.resetLocked()
+		return 0, false, fmt.Errorf("tokencounter: reading from redis: %w", err)
+	}
+	return used, allowed != 0, nil
+}
+
+func (s *redisStore) connLocked() (net.Conn, error) {
+	if s.conn != nil {
+		return s.conn, nil
+	}
+	conn, err := net.DialTimeout("tcp", s.addr, 2*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("tokencounter: dialing redis at %s: %w", s.addr, err)
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	return conn, nil
+}
+
+func (s *redisStore) resetLocked() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	s.conn = nil
+	s.reader = nil
+}
+
+// encodeRESPCommand renders args as a RESP array of bulk strings, the wire
+// format Redis expects for commands.
+func encodeRESPCommand(args ...string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
+
+// enforceBudget checks requestTokens against the configured limits before
+// the request is forwarded, rejecting it with 429 if it would exceed one.
+// On success it returns the key the request's usage is tracked under, for
+// commitBudget to add the response's tokens to once they're known.
+func (tc *TokenCounter) enforceBudget(rw http.ResponseWriter, req *http.Request, user string, requestTokens int) (key string, allowed bool) {
+	if tc.store == nil {
+		return "", true
+	}
+
+	if tc.budget.MaxRequestTokens > 0 && requestTokens > tc.budget.MaxRequestTokens {
+		tc.rejectBudget(rw, 0, 0)
+		return "", false
+	}
+
+	key = extractKey(tc.budget, req, user)
+	remaining := -1
+
+	if tc.budget.MaxTokensPerMinute > 0 {
+		used, allowed, err := tc.store.Incr(key+":minute", requestTokens, time.Minute, tc.budget.MaxTokensPerMinute)
+		if err != nil {
+			_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: budget store error: %v\n", err))
+		} else if !allowed {
+			tc.rejectBudget(rw, tc.budget.MaxTokensPerMinute-used, time.Minute)
+			return key, false
+		} else {
+			remaining = tc.budget.MaxTokensPerMinute - used
+		}
+	}
+
+	if tc.budget.MaxTokensPerDay > 0 {
+		used, allowed, err := tc.store.Incr(key+":day", requestTokens, 24*time.Hour, tc.budget.MaxTokensPerDay)
+		if err != nil {
+			_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: budget store error: %v\n", err))
+		} else if !allowed {
+			tc.rejectBudget(rw, tc.budget.MaxTokensPerDay-used, 24*time.Hour)
+			return key, false
+		} else if dayRemaining := tc.budget.MaxTokensPerDay - used; remaining == -1 || dayRemaining < remaining {
+			remaining = dayRemaining
+		}
+	}
+
+	if remaining >= 0 {
+		rw.Header().Set("X-RateLimit-Tokens-Remaining", strconv.Itoa(remaining))
+	}
+	return key, true
+}
+
+// commitBudget adds a response's tokens to key's windows once they're
+// known, which matters most for streaming responses whose completion size
+// couldn't be predicted at enforceBudget time.
+func (tc *TokenCounter) commitBudget(key string, tokens int) {
+	if tc.store == nil || key == "" || tokens <= 0 {
+		return
+	}
+	// The request was already allowed through, so its real cost always
+	// commits regardless of the limit: pass max as 0.
+	if tc.budget.MaxTokensPerMinute > 0 {
+		if _, _, err := tc.store.Incr(key+":minute", tokens, time.Minute, 0); err != nil {
+			_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: budget store error: %v\n", err))
+		}
+	}
+	if tc.budget.MaxTokensPerDay > 0 {
+		if _, _, err := tc.store.Incr(key+":day", tokens, 24*time.Hour, 0); err != nil {
+			_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: budget store error: %v\n", err))
+		}
+	}
+}
+
+func (tc *TokenCounter) rejectBudget(rw http.ResponseWriter, remaining int, retryAfter time.Duration) {
+	rw.Header().Set("X-RateLimit-Tokens-Remaining", strconv.Itoa(remaining))
+	if retryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	}
+	rw.WriteHeader(http.StatusTooManyRequests)
+}
+
+// readRESPInt reads one RESP reply and expects it to be an integer reply,
+// which is what EVAL returns for a script ending in `return <number>`.
+func readRESPInt(r *bufio.Reader) (int, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return 0, fmt.Errorf("tokencounter: empty redis reply")
+	}
+
+	switch line[0] {
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '-':
+		return 0, fmt.Errorf("redis error: %s", line[1:])
+	default:
+		return 0, fmt.Errorf("tokencounter: unexpected redis reply %q", line)
+	}
+}
+
+// readRESPIntPair reads one RESP reply and expects a two-element array of
+// integer replies, which is what EVAL returns for budgetIncrScript.
+func readRESPIntPair(r *bufio.Reader) (a, b int, err error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return 0, 0, fmt.Errorf("tokencounter: empty redis reply")
+	}
+
+	switch line[0] {
+	case '*':
+		n, convErr := strconv.Atoi(line[1:])
+		if convErr != nil || n != 2 {
+			return 0, 0, fmt.Errorf("tokencounter: unexpected redis array reply %q", line)
+		}
+		if a, err = readRESPInt(r); err != nil {
+			return 0, 0, err
+		}
+		if b, err = readRESPInt(r); err != nil {
+			return 0, 0, err
+		}
+		return a, b, nil
+	case '-':
+		return 0, 0, fmt.Errorf("redis error: %s", line[1:])
+	default:
+		return 0, 0, fmt.Errorf("tokencounter: unexpected redis reply %q", line)
+	}
+}
@@ -0,0 +1,435 @@
+package tokencounter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Endpoint names used to key EndpointsConfig and the registry below.
+const (
+	endpointChatCompletions   = "chatCompletions"
+	endpointEmbeddings        = "embeddings"
+	endpointLegacyCompletions = "completions"
+	endpointModerations       = "moderations"
+	endpointResponses         = "responses"
+)
+
+// EndpointsConfig toggles which OpenAI-compatible endpoints the plugin
+// counts tokens for. Every field defaults to true in CreateConfig; set one
+// to false to stop counting that endpoint while still forwarding its
+// requests untouched.
+type EndpointsConfig struct {
+	ChatCompletions bool `json:"chatCompletions,omitempty"`
+	Embeddings      bool `json:"embeddings,omitempty"`
+	Completions     bool `json:"completions,omitempty"`
+	Moderations     bool `json:"moderations,omitempty"`
+	Responses       bool `json:"responses,omitempty"`
+}
+
+// endpointSpec describes one path this plugin recognizes. pathSuffix is
+// matched in registry order, so more specific paths (chat completions) must
+// come before the legacy path they're a superset of (completions).
+type endpointSpec struct {
+	name       string
+	pathSuffix string
+	enabled    func(EndpointsConfig) bool
+}
+
+var endpointRegistry = []endpointSpec{
+	{endpointChatCompletions, "/chat/completions", func(e EndpointsConfig) bool { return e.ChatCompletions }},
+	{endpointEmbeddings, "/embeddings", func(e EndpointsConfig) bool { return e.Embeddings }},
+	{endpointModerations, "/moderations", func(e EndpointsConfig) bool { return e.Moderations }},
+	{endpointResponses, "/responses", func(e EndpointsConfig) bool { return e.Responses }},
+	{endpointLegacyCompletions, "/completions", func(e EndpointsConfig) bool { return e.Completions }},
+}
+
+// matchEndpoint returns the first registry entry whose pathSuffix occurs in
+// path, or nil if none match.
+func matchEndpoint(path string) *endpointSpec {
+	for i, ep := range endpointRegistry {
+		if strings.Contains(path, ep.pathSuffix) {
+			return &endpointRegistry[i]
+		}
+	}
+	return nil
+}
+
+// bufferWriter buffers a response's status code and body without
+// forwarding either, for the simpler endpoints that don't stream. That lets
+// the caller inspect the response, set its own token-count headers, and
+// only then flush the buffered status and body through to the real
+// ResponseWriter — setting headers after next.ServeHTTP returns is too late
+// once a real http.ResponseWriter has had Write or WriteHeader called, since
+// it will have already sent the header block to the client.
+type bufferWriter struct {
+	http.ResponseWriter
+	body       *bytes.Buffer
+	statusCode int
+}
+
+func (bw *bufferWriter) WriteHeader(code int) {
+	bw.statusCode = code
+}
+
+func (bw *bufferWriter) Write(b []byte) (int, error) {
+	return bw.body.Write(b)
+}
+
+// flush writes the buffered status code and body to the real
+// ResponseWriter, once the caller has finished setting any extra headers.
+func (bw *bufferWriter) flush() {
+	bw.ResponseWriter.WriteHeader(bw.statusCode)
+	_, _ = bw.ResponseWriter.Write(bw.body.Bytes())
+}
+
+// EmbeddingInput accepts every shape OpenAI's /v1/embeddings "input" field
+// allows: a single string, a list of strings, a single token array, or a
+// list of token arrays.
+type EmbeddingInput struct {
+	Strings []string
+	Tokens  [][]int
+}
+
+// UnmarshalJSON implements json.Unmarshaler by trying each accepted shape
+// in turn.
+func (e *EmbeddingInput) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		e.Strings = []string{s}
+		return nil
+	}
+	var strs []string
+	if err := json.Unmarshal(data, &strs); err == nil {
+		e.Strings = strs
+		return nil
+	}
+	var tokens []int
+	if err := json.Unmarshal(data, &tokens); err == nil {
+		e.Tokens = [][]int{tokens}
+		return nil
+	}
+	var tokenLists [][]int
+	if err := json.Unmarshal(data, &tokenLists); err == nil {
+		e.Tokens = tokenLists
+		return nil
+	}
+	return fmt.Errorf("tokencounter: unsupported embeddings input shape")
+}
+
+// EmbeddingsRequest represents an OpenAI /v1/embeddings request.
+type EmbeddingsRequest struct {
+	Model string         `json:"model"`
+	Input EmbeddingInput `json:"input"`
+}
+
+// EmbeddingsResponse represents an OpenAI /v1/embeddings response. It has
+// no completion side, so only PromptTokens is ever populated.
+type EmbeddingsResponse struct {
+	Model string `json:"model"`
+	Usage Usage  `json:"usage"`
+}
+
+func (tc *TokenCounter) countEmbeddingTokens(req *EmbeddingsRequest) int {
+	totalTokens := 0
+	for _, s := range req.Input.Strings {
+		totalTokens += tc.countText(req.Model, s)
+	}
+	for _, tokens := range req.Input.Tokens {
+		totalTokens += len(tokens)
+	}
+	return totalTokens
+}
+
+func (tc *TokenCounter) serveEmbeddings(rw http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: failed to read embeddings request body: %v\n", err))
+		tc.next.ServeHTTP(rw, req)
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	var embReq EmbeddingsRequest
+	if err := json.Unmarshal(body, &embReq); err != nil {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: failed to parse embeddings request: %v\n", err))
+		tc.next.ServeHTTP(rw, req)
+		return
+	}
+	setRequestModel(rw, embReq.Model)
+
+	respWriter := &bufferWriter{ResponseWriter: rw, body: &bytes.Buffer{}, statusCode: http.StatusOK}
+	tc.next.ServeHTTP(respWriter, req)
+
+	requestTokens := tc.countEmbeddingTokens(&embReq)
+
+	var embResp EmbeddingsResponse
+	if err := json.Unmarshal(respWriter.body.Bytes(), &embResp); err == nil && embResp.Usage.PromptTokens > 0 {
+		requestTokens = embResp.Usage.PromptTokens
+	}
+
+	rw.Header().Set(tc.embeddingTokenHeader, strconv.Itoa(requestTokens))
+	if tc.metrics != nil {
+		tc.metrics.ObserveTokenUsage(embReq.Model, endpointEmbeddings, "", requestTokens, 0)
+	}
+	respWriter.flush()
+}
+
+// LegacyPrompt accepts the legacy /v1/completions "prompt" field, which can
+// be a single string or a list of strings.
+type LegacyPrompt struct {
+	Values []string
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *LegacyPrompt) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		p.Values = []string{s}
+		return nil
+	}
+	var strs []string
+	if err := json.Unmarshal(data, &strs); err != nil {
+		return fmt.Errorf("tokencounter: unsupported prompt shape: %w", err)
+	}
+	p.Values = strs
+	return nil
+}
+
+// CompletionRequest represents a legacy /v1/completions request.
+type CompletionRequest struct {
+	Model  string       `json:"model"`
+	Prompt LegacyPrompt `json:"prompt"`
+}
+
+// CompletionChoice represents one choice in a legacy completion response.
+type CompletionChoice struct {
+	Text string `json:"text"`
+}
+
+// CompletionResponse represents a legacy /v1/completions response.
+type CompletionResponse struct {
+	Model   string             `json:"model"`
+	Usage   Usage              `json:"usage"`
+	Choices []CompletionChoice `json:"choices"`
+}
+
+func (tc *TokenCounter) serveLegacyCompletions(rw http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: failed to read completions request body: %v\n", err))
+		tc.next.ServeHTTP(rw, req)
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	var compReq CompletionRequest
+	if err := json.Unmarshal(body, &compReq); err != nil {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: failed to parse completions request: %v\n", err))
+		tc.next.ServeHTTP(rw, req)
+		return
+	}
+	setRequestModel(rw, compReq.Model)
+
+	respWriter := &bufferWriter{ResponseWriter: rw, body: &bytes.Buffer{}, statusCode: http.StatusOK}
+	tc.next.ServeHTTP(respWriter, req)
+
+	requestTokens := 0
+	for _, s := range compReq.Prompt.Values {
+		requestTokens += tc.countText(compReq.Model, s)
+	}
+
+	var compResp CompletionResponse
+	responseTokens := 0
+	if err := json.Unmarshal(respWriter.body.Bytes(), &compResp); err == nil {
+		if compResp.Usage.PromptTokens > 0 {
+			requestTokens = compResp.Usage.PromptTokens
+		}
+		if compResp.Usage.CompletionTokens > 0 {
+			responseTokens = compResp.Usage.CompletionTokens
+		} else {
+			for _, choice := range compResp.Choices {
+				responseTokens += tc.countText(compReq.Model, choice.Text)
+			}
+		}
+	}
+
+	rw.Header().Set(tc.completionRequestTokenHeader, strconv.Itoa(requestTokens))
+	rw.Header().Set(tc.completionResponseTokenHeader, strconv.Itoa(responseTokens))
+	if tc.metrics != nil {
+		tc.metrics.ObserveTokenUsage(compReq.Model, endpointLegacyCompletions, "", requestTokens, responseTokens)
+	}
+	respWriter.flush()
+}
+
+// ModerationInput accepts the /v1/moderations "input" field, a single
+// string or a list of strings.
+type ModerationInput struct {
+	Values []string
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *ModerationInput) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		m.Values = []string{s}
+		return nil
+	}
+	var strs []string
+	if err := json.Unmarshal(data, &strs); err != nil {
+		return fmt.Errorf("tokencounter: unsupported moderation input shape: %w", err)
+	}
+	m.Values = strs
+	return nil
+}
+
+// ModerationRequest represents an OpenAI /v1/moderations request. The
+// moderations endpoint has no completion side and OpenAI doesn't bill it,
+// so only a request-token count is ever produced.
+type ModerationRequest struct {
+	Model string          `json:"model"`
+	Input ModerationInput `json:"input"`
+}
+
+func (tc *TokenCounter) serveModerations(rw http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: failed to read moderations request body: %v\n", err))
+		tc.next.ServeHTTP(rw, req)
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	var modReq ModerationRequest
+	if err := json.Unmarshal(body, &modReq); err != nil {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: failed to parse moderations request: %v\n", err))
+		tc.next.ServeHTTP(rw, req)
+		return
+	}
+	setRequestModel(rw, modReq.Model)
+
+	requestTokens := 0
+	for _, s := range modReq.Input.Values {
+		requestTokens += tc.countText(modReq.Model, s)
+	}
+	rw.Header().Set(tc.moderationTokenHeader, strconv.Itoa(requestTokens))
+	if tc.metrics != nil {
+		tc.metrics.ObserveTokenUsage(modReq.Model, endpointModerations, "", requestTokens, 0)
+	}
+
+	tc.next.ServeHTTP(rw, req)
+}
+
+// ResponsesPart represents one content part of a Responses API message,
+// e.g. {"type":"input_text","text":"..."}.
+type ResponsesPart struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+}
+
+// ResponsesItem represents one item of a Responses API "input" or "output"
+// list: a role and its content parts.
+type ResponsesItem struct {
+	Role    string          `json:"role,omitempty"`
+	Content []ResponsesPart `json:"content,omitempty"`
+}
+
+// ResponsesInput accepts the Responses API "input" field, which can be a
+// plain string or a list of ResponsesItem.
+type ResponsesInput struct {
+	Items []ResponsesItem
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *ResponsesInput) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		r.Items = []ResponsesItem{{Content: []ResponsesPart{{Type: "input_text", Text: s}}}}
+		return nil
+	}
+	var items []ResponsesItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("tokencounter: unsupported responses input shape: %w", err)
+	}
+	r.Items = items
+	return nil
+}
+
+// ResponsesRequest represents an OpenAI Responses API request.
+type ResponsesRequest struct {
+	Model string         `json:"model"`
+	Input ResponsesInput `json:"input"`
+}
+
+// ResponsesUsage mirrors the Responses API's usage object, which names its
+// fields input_tokens/output_tokens instead of Chat Completions'
+// prompt_tokens/completion_tokens.
+type ResponsesUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// ResponsesResponse represents an OpenAI Responses API response.
+type ResponsesResponse struct {
+	Model  string          `json:"model"`
+	Usage  ResponsesUsage  `json:"usage"`
+	Output []ResponsesItem `json:"output,omitempty"`
+}
+
+func (tc *TokenCounter) countResponsesParts(model string, items []ResponsesItem) int {
+	totalTokens := 0
+	for _, item := range items {
+		for _, part := range item.Content {
+			totalTokens += tc.countText(model, part.Text)
+		}
+	}
+	return totalTokens
+}
+
+func (tc *TokenCounter) serveResponses(rw http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: failed to read responses request body: %v\n", err))
+		tc.next.ServeHTTP(rw, req)
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	var respReq ResponsesRequest
+	if err := json.Unmarshal(body, &respReq); err != nil {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: failed to parse responses request: %v\n", err))
+		tc.next.ServeHTTP(rw, req)
+		return
+	}
+	setRequestModel(rw, respReq.Model)
+
+	respWriter := &bufferWriter{ResponseWriter: rw, body: &bytes.Buffer{}, statusCode: http.StatusOK}
+	tc.next.ServeHTTP(respWriter, req)
+
+	requestTokens := tc.countResponsesParts(respReq.Model, respReq.Input.Items)
+
+	var respResp ResponsesResponse
+	responseTokens := 0
+	if err := json.Unmarshal(respWriter.body.Bytes(), &respResp); err == nil {
+		if respResp.Usage.InputTokens > 0 {
+			requestTokens = respResp.Usage.InputTokens
+		}
+		if respResp.Usage.OutputTokens > 0 {
+			responseTokens = respResp.Usage.OutputTokens
+		} else {
+			responseTokens = tc.countResponsesParts(respReq.Model, respResp.Output)
+		}
+	}
+
+	rw.Header().Set(tc.responsesRequestTokenHeader, strconv.Itoa(requestTokens))
+	rw.Header().Set(tc.responsesResponseTokenHeader, strconv.Itoa(responseTokens))
+	if tc.metrics != nil {
+		tc.metrics.ObserveTokenUsage(respReq.Model, endpointResponses, "", requestTokens, responseTokens)
+	}
+	respWriter.flush()
+}
@@ -0,0 +1,235 @@
+package tokencounter
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsLabels allowlists which labels are attached to exported metric
+// series. User is off by default since it's typically high-cardinality.
+type MetricsLabels struct {
+	Model    bool `json:"model,omitempty"`
+	Endpoint bool `json:"endpoint,omitempty"`
+	User     bool `json:"user,omitempty"`
+	Status   bool `json:"status,omitempty"`
+}
+
+// MetricsSink receives token and request observations as the plugin makes
+// them. promMetrics is the built-in implementation; alternate sinks can be
+// wired in by implementing this interface.
+type MetricsSink interface {
+	ObserveTokenUsage(model, endpoint, user string, promptTokens, completionTokens int)
+	ObserveRequest(model, endpoint, status string, duration time.Duration)
+}
+
+var (
+	durationBuckets         = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	tokensPerRequestBuckets = []float64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+)
+
+// labelSet is a small ordered set of label name/value pairs, used both as a
+// map key (via key()) and to render Prometheus `{a="b"}` syntax.
+type labelSet map[string]string
+
+func (l labelSet) key() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q,", name, l[name])
+	}
+	return b.String()
+}
+
+func (l labelSet) render() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%q", name, l[name])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (l labelSet) with(name, value string) labelSet {
+	out := make(labelSet, len(l)+1)
+	for k, v := range l {
+		out[k] = v
+	}
+	out[name] = value
+	return out
+}
+
+// histogram is a Prometheus-style cumulative histogram: counts[i] holds the
+// number of observations <= buckets[i].
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.sum += v
+	h.count++
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+}
+
+type counterEntry struct {
+	labels labelSet
+	value  float64
+}
+
+type histEntry struct {
+	labels labelSet
+	hist   *histogram
+}
+
+// promMetrics is a hand-rolled Prometheus exposition-format sink. Traefik's
+// Yaegi interpreter can't load client_golang, so this implements just
+// enough of the text format by hand: counters and histograms, with HELP/TYPE
+// preambles per family.
+type promMetrics struct {
+	labels MetricsLabels
+
+	mu               sync.Mutex
+	promptTokens     map[string]*counterEntry
+	completionTokens map[string]*counterEntry
+	requests         map[string]*counterEntry
+	duration         map[string]*histEntry
+	tokensPerRequest map[string]*histEntry
+}
+
+func newPromMetrics(labels MetricsLabels) *promMetrics {
+	return &promMetrics{
+		labels:           labels,
+		promptTokens:     make(map[string]*counterEntry),
+		completionTokens: make(map[string]*counterEntry),
+		requests:         make(map[string]*counterEntry),
+		duration:         make(map[string]*histEntry),
+		tokensPerRequest: make(map[string]*histEntry),
+	}
+}
+
+func (m *promMetrics) buildLabels(model, endpoint, user, status string) labelSet {
+	ls := labelSet{}
+	if m.labels.Model && model != "" {
+		ls["model"] = model
+	}
+	if m.labels.Endpoint && endpoint != "" {
+		ls["endpoint"] = endpoint
+	}
+	if m.labels.User && user != "" {
+		ls["user"] = user
+	}
+	if m.labels.Status && status != "" {
+		ls["status"] = status
+	}
+	return ls
+}
+
+// ObserveTokenUsage implements MetricsSink.
+func (m *promMetrics) ObserveTokenUsage(model, endpoint, user string, promptTokens, completionTokens int) {
+	ls := m.buildLabels(model, endpoint, user, "")
+	key := ls.key()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	addCounter(m.promptTokens, key, ls, float64(promptTokens))
+	addCounter(m.completionTokens, key, ls, float64(completionTokens))
+	observeHist(m.tokensPerRequest, key, ls, tokensPerRequestBuckets, float64(promptTokens+completionTokens))
+}
+
+// ObserveRequest implements MetricsSink.
+func (m *promMetrics) ObserveRequest(model, endpoint, status string, duration time.Duration) {
+	ls := m.buildLabels(model, endpoint, "", status)
+	key := ls.key()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	addCounter(m.requests, key, ls, 1)
+	observeHist(m.duration, key, ls, durationBuckets, duration.Seconds())
+}
+
+func addCounter(dst map[string]*counterEntry, key string, ls labelSet, delta float64) {
+	e, ok := dst[key]
+	if !ok {
+		e = &counterEntry{labels: ls}
+		dst[key] = e
+	}
+	e.value += delta
+}
+
+func observeHist(dst map[string]*histEntry, key string, ls labelSet, buckets []float64, v float64) {
+	e, ok := dst[key]
+	if !ok {
+		e = &histEntry{labels: ls, hist: newHistogram(buckets)}
+		dst[key] = e
+	}
+	e.hist.observe(v)
+}
+
+// ServeHTTP renders every tracked series in Prometheus text exposition
+// format.
+func (m *promMetrics) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	writeCounterFamily(&b, "tokencounter_prompt_tokens_total", "Total prompt tokens counted.", m.promptTokens)
+	writeCounterFamily(&b, "tokencounter_completion_tokens_total", "Total completion tokens counted.", m.completionTokens)
+	writeCounterFamily(&b, "tokencounter_requests_total", "Total requests counted.", m.requests)
+	writeHistogramFamily(&b, "tokencounter_request_duration_seconds", "Request duration in seconds.", m.duration)
+	writeHistogramFamily(&b, "tokencounter_tokens_per_request", "Prompt plus completion tokens per request.", m.tokensPerRequest)
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = rw.Write([]byte(b.String()))
+}
+
+func writeCounterFamily(b *strings.Builder, name, help string, entries map[string]*counterEntry) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, e := range entries {
+		fmt.Fprintf(b, "%s%s %v\n", name, e.labels.render(), e.value)
+	}
+}
+
+func writeHistogramFamily(b *strings.Builder, name, help string, entries map[string]*histEntry) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, e := range entries {
+		h := e.hist
+		for i, bound := range h.buckets {
+			le := e.labels.with("le", strconv.FormatFloat(bound, 'g', -1, 64))
+			fmt.Fprintf(b, "%s_bucket%s %d\n", name, le.render(), h.counts[i])
+		}
+		le := e.labels.with("le", "+Inf")
+		fmt.Fprintf(b, "%s_bucket%s %d\n", name, le.render(), h.count)
+		fmt.Fprintf(b, "%s_sum%s %v\n", name, e.labels.render(), h.sum)
+		fmt.Fprintf(b, "%s_count%s %d\n", name, e.labels.render(), h.count)
+	}
+}
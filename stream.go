@@ -0,0 +1,105 @@
+package tokencounter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// sseChunk is the shape of one `data:` payload in a chat completion SSE
+// stream. Usage is only present on the final chunk, and only when the
+// upstream request set `stream_options.include_usage`.
+type sseChunk struct {
+	Model   string   `json:"model"`
+	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
+}
+
+// sseAccumulator incrementally parses `data: {...}\n\n` frames as they
+// stream through the plugin, tallying completion tokens from delta content
+// and tool-call arguments through the tokenizer so the final count is
+// available without ever buffering the whole response.
+type sseAccumulator struct {
+	tc  *TokenCounter
+	req *OpenAIRequest
+
+	buf              bytes.Buffer
+	completionTokens int
+	promptTokens     int
+	usageSeen        bool
+	doneSeen         bool
+	usageEventSent   bool
+}
+
+func newSSEAccumulator(tc *TokenCounter, req *OpenAIRequest) *sseAccumulator {
+	return &sseAccumulator{tc: tc, req: req}
+}
+
+// feed parses as many complete "\n\n"-delimited frames as b and any
+// previously buffered remainder contain, holding back an incomplete tail
+// frame for the next call.
+func (a *sseAccumulator) feed(b []byte) {
+	a.buf.Write(b)
+
+	for {
+		raw := a.buf.Bytes()
+		idx := bytes.Index(raw, []byte("\n\n"))
+		if idx == -1 {
+			break
+		}
+		frame := append([]byte(nil), raw[:idx]...)
+		a.buf.Next(idx + 2)
+		a.handleFrame(frame)
+	}
+}
+
+func (a *sseAccumulator) handleFrame(frame []byte) {
+	for _, line := range bytes.Split(frame, []byte("\n")) {
+		line = bytes.TrimSpace(bytes.TrimPrefix(bytes.TrimSpace(line), []byte("data:")))
+		if len(line) == 0 {
+			continue
+		}
+		if bytes.Equal(line, []byte("[DONE]")) {
+			a.doneSeen = true
+			continue
+		}
+
+		var chunk sseChunk
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			continue
+		}
+
+		if chunk.Usage != nil {
+			a.promptTokens = chunk.Usage.PromptTokens
+			a.completionTokens = chunk.Usage.CompletionTokens
+			a.usageSeen = true
+			continue
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.Delta == nil {
+				continue
+			}
+			a.completionTokens += a.tc.countContent(chunk.Model, choice.Delta.Content)
+			for _, call := range choice.Delta.ToolCalls {
+				a.completionTokens += a.tc.countText(chunk.Model, call.Function.Arguments)
+			}
+		}
+	}
+}
+
+// counts returns the final request/response token counts, preferring an
+// exact usage block the upstream sent over the running tally.
+func (a *sseAccumulator) counts(req *OpenAIRequest) (requestTokens, responseTokens int) {
+	if a.usageSeen {
+		return a.promptTokens, a.completionTokens
+	}
+	return a.tc.countRequestTokens(req), a.completionTokens
+}
+
+// usageEvent renders the running counts as a synthetic SSE frame so clients
+// that cannot read HTTP trailers still get a usage signal.
+func (a *sseAccumulator) usageEvent() []byte {
+	requestTokens, responseTokens := a.counts(a.req)
+	return []byte(fmt.Sprintf("data: {\"object\":\"token.usage\",\"prompt_tokens\":%d,\"completion_tokens\":%d}\n\n", requestTokens, responseTokens))
+}
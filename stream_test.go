@@ -0,0 +1,53 @@
+package tokencounter
+
+import "testing"
+
+func TestSSEAccumulatorCountsFromDelta(t *testing.T) {
+	tc := &TokenCounter{}
+	req := &OpenAIRequest{Model: "gpt-3.5-turbo"}
+	acc := newSSEAccumulator(tc, req)
+
+	acc.feed([]byte("data: {\"model\":\"gpt-3.5-turbo\",\"choices\":[{\"delta\":{\"content\":\"hello world\"}}]}\n\n"))
+	acc.feed([]byte("data: [DONE]\n\n"))
+
+	requestTokens, responseTokens := acc.counts(req)
+	if responseTokens == 0 {
+		t.Error("expected non-zero response tokens tallied from delta content")
+	}
+	if requestTokens == 0 {
+		t.Error("expected non-zero request tokens estimated from the original request")
+	}
+	if !acc.doneSeen {
+		t.Error("expected doneSeen to be set after a [DONE] frame")
+	}
+}
+
+func TestSSEAccumulatorPrefersFinalUsageBlock(t *testing.T) {
+	tc := &TokenCounter{}
+	req := &OpenAIRequest{Model: "gpt-3.5-turbo"}
+	acc := newSSEAccumulator(tc, req)
+
+	acc.feed([]byte("data: {\"model\":\"gpt-3.5-turbo\",\"choices\":[{\"delta\":{\"content\":\"hello\"}}]}\n\n"))
+	acc.feed([]byte("data: {\"model\":\"gpt-3.5-turbo\",\"usage\":{\"prompt_tokens\":11,\"completion_tokens\":22}}\n\n"))
+
+	requestTokens, responseTokens := acc.counts(req)
+	if requestTokens != 11 || responseTokens != 22 {
+		t.Errorf("counts() = (%d, %d), want (11, 22) from the usage block", requestTokens, responseTokens)
+	}
+}
+
+func TestSSEAccumulatorFeedAcrossPartialWrites(t *testing.T) {
+	tc := &TokenCounter{}
+	req := &OpenAIRequest{Model: "gpt-3.5-turbo"}
+	acc := newSSEAccumulator(tc, req)
+
+	frame := "data: {\"model\":\"gpt-3.5-turbo\",\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n"
+	// Split the frame mid-write to exercise the buffered-remainder path.
+	acc.feed([]byte(frame[:10]))
+	acc.feed([]byte(frame[10:]))
+
+	_, responseTokens := acc.counts(req)
+	if responseTokens == 0 {
+		t.Error("expected tokens tallied once the split frame completes")
+	}
+}
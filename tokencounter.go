@@ -1,4 +1,4 @@
-// Package tokencounter a token counter plugin for OpenAI Chat Completion API.
+// Package tokencounter a token counter plugin for OpenAI-compatible APIs.
 package tokencounter
 
 import (
@@ -11,13 +11,63 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
+
+	"github.com/zalbiraw/tokencounter/tokenizer"
+)
+
+// tokensPerMessage, tokensPerName, and tokensPerReply are the ChatML framing
+// overheads OpenAI documents: every message costs 3 tokens of framing, a
+// "name" field costs 1 more, and the reply is primed with 3 trailing tokens.
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
 )
 
 // Config the plugin configuration.
 type Config struct {
 	RequestTokenHeader  string `json:"requestTokenHeader,omitempty"`
 	ResponseTokenHeader string `json:"responseTokenHeader,omitempty"`
+	// TokenizerPath points at an operator-supplied BPE merges file to load
+	// for BPE token counts (see the tokenizer package doc comment for the
+	// expected file format; no merges file ships with this plugin). The same
+	// file is loaded for both cl100k_base and o200k_base, and the counts use
+	// an approximate pre-tokenizer, so they are not guaranteed to match
+	// OpenAI's. This is opt-in: when left empty, the default and out of
+	// the box behavior, the plugin falls back to the word-count heuristic.
+	TokenizerPath string `json:"tokenizerPath,omitempty"`
+	// TrailerTokenHeaders emits the token-count headers as HTTP trailers and
+	// a synthetic "token.usage" SSE event for streaming responses, since
+	// regular headers can no longer be set once the body has started
+	// flushing.
+	TrailerTokenHeaders bool `json:"trailerTokenHeaders,omitempty"`
+	// Endpoints toggles which OpenAI-compatible endpoints are counted.
+	Endpoints EndpointsConfig `json:"endpoints,omitempty"`
+	// EmbeddingTokenHeader overrides the header used for /v1/embeddings
+	// request-token counts.
+	EmbeddingTokenHeader string `json:"embeddingTokenHeader,omitempty"`
+	// CompletionRequestTokenHeader and CompletionResponseTokenHeader
+	// override the headers used for legacy /v1/completions counts.
+	CompletionRequestTokenHeader  string `json:"completionRequestTokenHeader,omitempty"`
+	CompletionResponseTokenHeader string `json:"completionResponseTokenHeader,omitempty"`
+	// ModerationTokenHeader overrides the header used for /v1/moderations
+	// request-token counts.
+	ModerationTokenHeader string `json:"moderationTokenHeader,omitempty"`
+	// ResponsesRequestTokenHeader and ResponsesResponseTokenHeader override
+	// the headers used for the Responses API's counts.
+	ResponsesRequestTokenHeader  string `json:"responsesRequestTokenHeader,omitempty"`
+	ResponsesResponseTokenHeader string `json:"responsesResponseTokenHeader,omitempty"`
+	// Budget enables token budget / rate-limit enforcement for chat
+	// completions. Left zero-valued, no limits are enforced.
+	Budget BudgetConfig `json:"budget,omitempty"`
+	// MetricsPath, when set, serves Prometheus exposition-format metrics at
+	// that path instead of forwarding it upstream.
+	MetricsPath string `json:"metricsPath,omitempty"`
+	// MetricsLabels allowlists which labels are attached to the metrics
+	// MetricsPath serves.
+	MetricsLabels MetricsLabels `json:"metricsLabels,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -25,15 +75,49 @@ func CreateConfig() *Config {
 	return &Config{
 		RequestTokenHeader:  "X-Request-Token-Count",
 		ResponseTokenHeader: "X-Response-Token-Count",
+		Endpoints: EndpointsConfig{
+			ChatCompletions: true,
+			Embeddings:      true,
+			Completions:     true,
+			Moderations:     true,
+			Responses:       true,
+		},
+		EmbeddingTokenHeader:          "X-Embedding-Token-Count",
+		CompletionRequestTokenHeader:  "X-Request-Token-Count",
+		CompletionResponseTokenHeader: "X-Response-Token-Count",
+		ModerationTokenHeader:         "X-Request-Token-Count",
+		ResponsesRequestTokenHeader:   "X-Request-Token-Count",
+		ResponsesResponseTokenHeader:  "X-Response-Token-Count",
+		MetricsLabels: MetricsLabels{
+			Model:    true,
+			Endpoint: true,
+			Status:   true,
+			// User is left off by default since it's typically high
+			// cardinality; operators opt in explicitly.
+		},
 	}
 }
 
 // TokenCounter a token counter plugin.
 type TokenCounter struct {
-	next                http.Handler
-	requestTokenHeader  string
-	responseTokenHeader string
-	name                string
+	next                          http.Handler
+	requestTokenHeader            string
+	responseTokenHeader           string
+	name                          string
+	encodings                     map[string]*tokenizer.Encoding
+	trailerTokenHeaders           bool
+	endpoints                     EndpointsConfig
+	embeddingTokenHeader          string
+	completionRequestTokenHeader  string
+	completionResponseTokenHeader string
+	moderationTokenHeader         string
+	responsesRequestTokenHeader   string
+	responsesResponseTokenHeader  string
+	budget                        BudgetConfig
+	store                         Store
+	metrics                       MetricsSink
+	metricsHandler                http.Handler
+	metricsPath                   string
 }
 
 // New creates a new TokenCounter plugin.
@@ -44,12 +128,73 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 	if config.ResponseTokenHeader == "" {
 		config.ResponseTokenHeader = "X-Response-Token-Count"
 	}
+	if config.EmbeddingTokenHeader == "" {
+		config.EmbeddingTokenHeader = "X-Embedding-Token-Count"
+	}
+	if config.CompletionRequestTokenHeader == "" {
+		config.CompletionRequestTokenHeader = "X-Request-Token-Count"
+	}
+	if config.CompletionResponseTokenHeader == "" {
+		config.CompletionResponseTokenHeader = "X-Response-Token-Count"
+	}
+	if config.ModerationTokenHeader == "" {
+		config.ModerationTokenHeader = "X-Request-Token-Count"
+	}
+	if config.ResponsesRequestTokenHeader == "" {
+		config.ResponsesRequestTokenHeader = "X-Request-Token-Count"
+	}
+	if config.ResponsesResponseTokenHeader == "" {
+		config.ResponsesResponseTokenHeader = "X-Response-Token-Count"
+	}
+
+	var encodings map[string]*tokenizer.Encoding
+	if config.TokenizerPath != "" {
+		encodings = make(map[string]*tokenizer.Encoding)
+		for _, encName := range []string{tokenizer.CL100KBase, tokenizer.O200KBase} {
+			enc, err := tokenizer.Load(encName, config.TokenizerPath)
+			if err != nil {
+				return nil, fmt.Errorf("tokencounter: loading %s tokenizer: %w", encName, err)
+			}
+			encodings[encName] = enc
+		}
+	}
+
+	var store Store
+	if config.Budget.enabled() {
+		if config.Budget.RedisAddr != "" {
+			store = newRedisStore(config.Budget.RedisAddr)
+		} else {
+			store = newMemoryStore()
+		}
+	}
+
+	var metrics MetricsSink
+	var metricsHandler http.Handler
+	if config.MetricsPath != "" {
+		pm := newPromMetrics(config.MetricsLabels)
+		metrics = pm
+		metricsHandler = pm
+	}
 
 	return &TokenCounter{
-		next:                next,
-		requestTokenHeader:  config.RequestTokenHeader,
-		responseTokenHeader: config.ResponseTokenHeader,
-		name:                name,
+		next:                          next,
+		requestTokenHeader:            config.RequestTokenHeader,
+		responseTokenHeader:           config.ResponseTokenHeader,
+		name:                          name,
+		encodings:                     encodings,
+		trailerTokenHeaders:           config.TrailerTokenHeaders,
+		endpoints:                     config.Endpoints,
+		embeddingTokenHeader:          config.EmbeddingTokenHeader,
+		completionRequestTokenHeader:  config.CompletionRequestTokenHeader,
+		completionResponseTokenHeader: config.CompletionResponseTokenHeader,
+		moderationTokenHeader:         config.ModerationTokenHeader,
+		responsesRequestTokenHeader:   config.ResponsesRequestTokenHeader,
+		responsesResponseTokenHeader:  config.ResponsesResponseTokenHeader,
+		budget:                        config.Budget,
+		store:                         store,
+		metrics:                       metrics,
+		metricsHandler:                metricsHandler,
+		metricsPath:                   config.MetricsPath,
 	}, nil
 }
 
@@ -175,33 +320,144 @@ type OpenAIResponse struct {
 
 type responseWriter struct {
 	http.ResponseWriter
-	body       *bytes.Buffer
-	statusCode int
+	tc            *TokenCounter
+	req           *OpenAIRequest
+	body          *bytes.Buffer
+	statusCode    int
+	headerWritten bool
+	streaming     bool
+	sse           *sseAccumulator
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
+	if !rw.headerWritten {
+		rw.headerWritten = true
+		if strings.HasPrefix(rw.Header().Get("Content-Type"), "text/event-stream") {
+			rw.streaming = true
+			rw.sse = newSSEAccumulator(rw.tc, rw.req)
+			if rw.tc.trailerTokenHeaders {
+				rw.Header().Add("Trailer", rw.tc.requestTokenHeader)
+				rw.Header().Add("Trailer", rw.tc.responseTokenHeader)
+			}
+		}
+	}
 	rw.ResponseWriter.WriteHeader(code)
 }
 
 func (rw *responseWriter) Write(b []byte) (int, error) {
-	rw.body.Write(b)
-	return rw.ResponseWriter.Write(b)
+	if !rw.headerWritten {
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if !rw.streaming {
+		rw.body.Write(b)
+		return rw.ResponseWriter.Write(b)
+	}
+
+	rw.sse.feed(b)
+	// The synthetic usage event must precede the frame carrying [DONE]:
+	// most SSE clients, including OpenAI's own SDKs, stop reading as soon as
+	// they see it, so anything written after would never be seen.
+	if rw.sse.doneSeen && !rw.sse.usageEventSent && rw.tc.trailerTokenHeaders {
+		rw.sse.usageEventSent = true
+		if _, err := rw.ResponseWriter.Write(rw.sse.usageEvent()); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.Flush()
+	return n, err
 }
 
+// Flush implements http.Flusher so upstream SSE chunks reach the client as
+// they arrive instead of being held until the handler returns.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// statusRecorder wraps a ResponseWriter to observe the status code a handler
+// settles on and the model it parsed from the request body, both needed for
+// the requests_total metric but not known until the endpoint handler runs.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	model      string
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.statusCode = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Flush implements http.Flusher so wrapping a statusRecorder around a
+// streaming responseWriter doesn't break chunk-by-chunk flushing.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// setRequestModel records model on rw for the requests_total metric, if rw
+// is a *statusRecorder. It's a no-op otherwise, e.g. when metrics are
+// disabled and dispatch was handed the bare ResponseWriter.
+func setRequestModel(rw http.ResponseWriter, model string) {
+	if rec, ok := rw.(*statusRecorder); ok {
+		rec.model = model
+	}
+}
+
+// ServeHTTP dispatches recognized OpenAI-compatible endpoints to their
+// counter, and passes everything else straight through untouched.
 func (tc *TokenCounter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if tc.metricsHandler != nil && req.URL.Path == tc.metricsPath {
+		tc.metricsHandler.ServeHTTP(rw, req)
+		return
+	}
+
 	if req.Method != http.MethodPost {
 		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: bypassing non-POST request to %s\n", req.URL.Path))
 		tc.next.ServeHTTP(rw, req)
 		return
 	}
 
-	if !strings.Contains(req.URL.Path, "/chat/completions") {
-		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: bypassing non-chat-completions request to %s\n", req.URL.Path))
+	ep := matchEndpoint(req.URL.Path)
+	if ep == nil || !ep.enabled(tc.endpoints) {
+		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: bypassing unrecognized request to %s\n", req.URL.Path))
 		tc.next.ServeHTTP(rw, req)
 		return
 	}
 
+	if tc.metrics == nil {
+		tc.dispatch(ep, rw, req)
+		return
+	}
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: rw, statusCode: http.StatusOK}
+	tc.dispatch(ep, rec, req)
+	tc.metrics.ObserveRequest(rec.model, ep.name, strconv.Itoa(rec.statusCode), time.Since(start))
+}
+
+// dispatch routes to the per-endpoint handler for ep.
+func (tc *TokenCounter) dispatch(ep *endpointSpec, rw http.ResponseWriter, req *http.Request) {
+	switch ep.name {
+	case endpointEmbeddings:
+		tc.serveEmbeddings(rw, req)
+	case endpointLegacyCompletions:
+		tc.serveLegacyCompletions(rw, req)
+	case endpointModerations:
+		tc.serveModerations(rw, req)
+	case endpointResponses:
+		tc.serveResponses(rw, req)
+	default:
+		tc.serveChatCompletions(rw, req)
+	}
+}
+
+func (tc *TokenCounter) serveChatCompletions(rw http.ResponseWriter, req *http.Request) {
 	body, err := io.ReadAll(req.Body)
 	if err != nil {
 		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: failed to read request body: %v\n", err))
@@ -216,18 +472,36 @@ func (tc *TokenCounter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		tc.next.ServeHTTP(rw, req)
 		return
 	}
+	setRequestModel(rw, openAIReq.Model)
+
+	requestTokens := tc.countRequestTokens(&openAIReq)
+	budgetKey, allowed := tc.enforceBudget(rw, req, openAIReq.User, requestTokens)
+	if !allowed {
+		return
+	}
 
 	respWriter := &responseWriter{
 		ResponseWriter: rw,
+		tc:             tc,
+		req:            &openAIReq,
 		body:           &bytes.Buffer{},
 		statusCode:     http.StatusOK,
 	}
 
 	tc.next.ServeHTTP(respWriter, req)
 
+	if respWriter.streaming {
+		requestTokens, responseTokens := respWriter.sse.counts(&openAIReq)
+		tc.commitBudget(budgetKey, responseTokens)
+		if tc.trailerTokenHeaders {
+			rw.Header().Set(tc.requestTokenHeader, strconv.Itoa(requestTokens))
+			rw.Header().Set(tc.responseTokenHeader, strconv.Itoa(responseTokens))
+		}
+		return
+	}
+
 	// Handle non-successful responses
 	if respWriter.statusCode != http.StatusOK {
-		requestTokens := tc.countRequestTokens(&openAIReq)
 		rw.Header().Set(tc.requestTokenHeader, strconv.Itoa(requestTokens))
 		return
 	}
@@ -236,41 +510,62 @@ func (tc *TokenCounter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var openAIResp OpenAIResponse
 	if err := json.Unmarshal(respWriter.body.Bytes(), &openAIResp); err != nil {
 		_, _ = os.Stderr.WriteString(fmt.Sprintf("TokenCounter: failed to parse OpenAI response: %v\n", err))
-		tc.setEstimatedTokens(rw, &openAIReq, &openAIResp)
+		responseTokens := tc.setEstimatedTokens(rw, &openAIReq, &openAIResp)
+		tc.commitBudget(budgetKey, responseTokens)
+		return
+	}
+
+	// A cache hit carries a zeroed usage block, so estimate its tokens.
+	if openAIResp.Usage.PromptTokens == 0 && openAIResp.Usage.CompletionTokens == 0 {
+		responseTokens := tc.setEstimatedTokens(rw, &openAIReq, &openAIResp)
+		tc.commitBudget(budgetKey, responseTokens)
 		return
 	}
 
 	// Use actual token counts from OpenAI response
-	tc.setActualTokens(rw, &openAIResp)
+	responseTokens := tc.setActualTokens(rw, &openAIResp)
+	tc.commitBudget(budgetKey, responseTokens)
 }
 
-func (tc *TokenCounter) setEstimatedTokens(rw http.ResponseWriter, req *OpenAIRequest, resp *OpenAIResponse) {
+func (tc *TokenCounter) setEstimatedTokens(rw http.ResponseWriter, req *OpenAIRequest, resp *OpenAIResponse) int {
 	requestTokens := tc.countRequestTokens(req)
 	responseTokens := tc.countResponseTokens(resp)
 	rw.Header().Set(tc.requestTokenHeader, strconv.Itoa(requestTokens))
 	rw.Header().Set(tc.responseTokenHeader, strconv.Itoa(responseTokens))
+	if tc.metrics != nil {
+		// Cache hits return a zeroed usage block, so this is the only place
+		// their tokens are ever counted.
+		tc.metrics.ObserveTokenUsage(req.Model, endpointChatCompletions, req.User, requestTokens, responseTokens)
+	}
+	return responseTokens
 }
 
-func (tc *TokenCounter) setActualTokens(rw http.ResponseWriter, resp *OpenAIResponse) {
+func (tc *TokenCounter) setActualTokens(rw http.ResponseWriter, resp *OpenAIResponse) int {
 	if resp.Usage.PromptTokens > 0 {
 		rw.Header().Set(tc.requestTokenHeader, strconv.Itoa(resp.Usage.PromptTokens))
 	}
 	if resp.Usage.CompletionTokens > 0 {
 		rw.Header().Set(tc.responseTokenHeader, strconv.Itoa(resp.Usage.CompletionTokens))
 	}
+	if tc.metrics != nil {
+		tc.metrics.ObserveTokenUsage(resp.Model, endpointChatCompletions, "", resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	}
+	return resp.Usage.CompletionTokens
 }
 
 func (tc *TokenCounter) countRequestTokens(req *OpenAIRequest) int {
 	totalTokens := 0
 
 	for _, message := range req.Messages {
-		totalTokens += tc.estimateTokensFromContent(message.Content)
-		totalTokens += tc.estimateTokens(message.Role)
-		totalTokens += 4
+		totalTokens += tokensPerMessage
+		totalTokens += tc.countText(req.Model, message.Role)
+		totalTokens += tc.countContent(req.Model, message.Content)
+		if message.Name != "" {
+			totalTokens += tokensPerName
+			totalTokens += tc.countText(req.Model, message.Name)
+		}
 	}
-
-	totalTokens += tc.estimateTokens(req.Model)
-	totalTokens += 2
+	totalTokens += tokensPerReply
 
 	return totalTokens
 }
@@ -282,20 +577,31 @@ func (tc *TokenCounter) countResponseTokens(resp *OpenAIResponse) int {
 
 	totalTokens := 0
 	for _, choice := range resp.Choices {
-		totalTokens += tc.estimateTokensFromContent(choice.Message.Content)
+		totalTokens += tc.countContent(resp.Model, choice.Message.Content)
 	}
 
 	return totalTokens
 }
 
-func (tc *TokenCounter) estimateTokensFromContent(content MessageContent) int {
+// countText returns the BPE token count for text under model's encoding
+// when a tokenizer is configured, or the word-count heuristic otherwise.
+// The BPE count uses the tokenizer package's approximate pre-tokenizer, so
+// it can differ from OpenAI's own count.
+func (tc *TokenCounter) countText(model, text string) int {
+	if enc, ok := tc.encodings[tokenizer.ModelToEncoding(model)]; ok {
+		return len(enc.Encode(text))
+	}
+	return tc.estimateTokens(text)
+}
+
+func (tc *TokenCounter) countContent(model string, content MessageContent) int {
 	if content == nil {
 		return 0
 	}
 
 	switch c := content.(type) {
 	case string:
-		return tc.estimateTokens(c)
+		return tc.countText(model, c)
 	case []interface{}:
 		totalTokens := 0
 		for _, item := range c {
@@ -303,7 +609,7 @@ func (tc *TokenCounter) estimateTokensFromContent(content MessageContent) int {
 				if itemType, exists := itemMap["type"]; exists && itemType == "text" {
 					if text, textExists := itemMap["text"]; textExists {
 						if textStr, ok := text.(string); ok {
-							totalTokens += tc.estimateTokens(textStr)
+							totalTokens += tc.countText(model, textStr)
 						}
 					}
 				} else if itemType == "image_url" {
@@ -0,0 +1,157 @@
+// Package tokenizer implements a minimal byte-pair-encoding tokenizer
+// compatible with OpenAI's cl100k_base and o200k_base encodings. Byte-exact
+// counts require loading a real merges table with Load; this package ships
+// no such table, so operators must source one themselves (e.g. by exporting
+// tiktoken's `.tiktoken` files to the plain-text format Load expects).
+package tokenizer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Encoding names, matching the values OpenAI's tokenizers use.
+const (
+	CL100KBase = "cl100k_base"
+	O200KBase  = "o200k_base"
+)
+
+// pretokenizeRe approximates the GPT-style pre-tokenizer: it splits common
+// contractions, then runs of letters, digits, other non-space characters,
+// and whitespace into separate pieces. Go's RE2 engine does not support the
+// possessive quantifiers and lookahead the reference regex uses, so this is
+// a close, RE2-safe approximation rather than a byte-for-byte port.
+var pretokenizeRe = regexp.MustCompile(`(?i)'s|'t|'re|'ve|'m|'ll|'d| ?[[:alpha:]]+| ?[[:digit:]]+| ?[^\s[:alpha:][:digit:]]+|\s+`)
+
+// Encoding is a loaded BPE vocabulary. Encode splits text into pieces with
+// the package-level pretokenizeRe before the merge loop runs.
+type Encoding struct {
+	name  string
+	ranks map[string]int
+}
+
+// ModelToEncoding maps an OpenAI model name to the encoding it tokenizes
+// with, falling back to cl100k_base for anything unrecognized.
+func ModelToEncoding(model string) string {
+	switch {
+	case strings.HasPrefix(model, "gpt-4o"), strings.HasPrefix(model, "o1"), strings.HasPrefix(model, "o3"):
+		return O200KBase
+	case strings.HasPrefix(model, "gpt-4"), strings.HasPrefix(model, "gpt-3.5"):
+		return CL100KBase
+	default:
+		return CL100KBase
+	}
+}
+
+// Load reads a merges file at path and returns an Encoding for it. The file
+// format is one vocabulary entry per line: the raw token bytes followed by
+// a space and its rank, e.g. produced by exporting tiktoken's `.tiktoken`
+// files to plain bytes. If path is empty, Load returns a byte-level
+// fallback encoding (one token per byte) so callers always get an Encode
+// that works, just without real merges — no merges table ships with this
+// package, so exact counts are opt-in and require an operator-supplied file.
+func Load(name, path string) (*Encoding, error) {
+	if path == "" {
+		return &Encoding{name: name, ranks: byteRanks()}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("tokenizer: opening merges file %q: %w", path, err)
+	}
+	defer f.Close()
+
+	ranks := byteRanks()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		sep := strings.LastIndexByte(line, ' ')
+		if sep == -1 {
+			continue
+		}
+		rank, err := strconv.Atoi(line[sep+1:])
+		if err != nil {
+			continue
+		}
+		ranks[line[:sep]] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("tokenizer: reading merges file %q: %w", path, err)
+	}
+
+	return &Encoding{name: name, ranks: ranks}, nil
+}
+
+// byteRanks seeds a ranks table with every single byte value, which is the
+// base vocabulary every BPE merge builds on top of and the minimum needed
+// for the merge loop to terminate.
+func byteRanks() map[string]int {
+	ranks := make(map[string]int, 256)
+	for i := 0; i < 256; i++ {
+		ranks[string([]byte{byte(i)})] = i
+	}
+	return ranks
+}
+
+// Name reports the encoding name this Encoding was loaded as.
+func (e *Encoding) Name() string {
+	return e.name
+}
+
+// Encode splits text with the GPT-style pre-tokenizer and BPE-merges each
+// resulting piece, returning the resulting token ids.
+func (e *Encoding) Encode(text string) []int {
+	if text == "" {
+		return nil
+	}
+
+	var ids []int
+	for _, piece := range pretokenizeRe.FindAllString(text, -1) {
+		ids = append(ids, e.bpe([]byte(piece))...)
+	}
+	return ids
+}
+
+// bpe runs the standard byte-pair-encoding merge loop: start from one token
+// per byte, repeatedly merge the adjacent pair with the lowest rank until no
+// ranked pair remains, then look up the resulting byte strings.
+func (e *Encoding) bpe(piece []byte) []int {
+	if len(piece) == 0 {
+		return nil
+	}
+
+	parts := make([]string, len(piece))
+	for i, b := range piece {
+		parts[i] = string([]byte{b})
+	}
+
+	for len(parts) > 1 {
+		bestRank := -1
+		bestIdx := -1
+		for i := 0; i < len(parts)-1; i++ {
+			pair := parts[i] + parts[i+1]
+			if rank, ok := e.ranks[pair]; ok && (bestRank == -1 || rank < bestRank) {
+				bestRank = rank
+				bestIdx = i
+			}
+		}
+		if bestIdx == -1 {
+			break
+		}
+		parts[bestIdx] += parts[bestIdx+1]
+		parts = append(parts[:bestIdx+1], parts[bestIdx+2:]...)
+	}
+
+	ids := make([]int, len(parts))
+	for i, p := range parts {
+		ids[i] = e.ranks[p]
+	}
+	return ids
+}
@@ -0,0 +1,82 @@
+package tokenizer
+
+import (
+	"os"
+	"testing"
+)
+
+func TestModelToEncoding(t *testing.T) {
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"gpt-4o-mini", O200KBase},
+		{"o1-preview", O200KBase},
+		{"o3-mini", O200KBase},
+		{"gpt-4-turbo", CL100KBase},
+		{"gpt-3.5-turbo", CL100KBase},
+		{"text-davinci-003", CL100KBase},
+	}
+
+	for _, tt := range tests {
+		if got := ModelToEncoding(tt.model); got != tt.want {
+			t.Errorf("ModelToEncoding(%q) = %q, want %q", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestLoadEmptyPathFallsBackToByteLevel(t *testing.T) {
+	enc, err := Load(CL100KBase, "")
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if enc.Name() != CL100KBase {
+		t.Errorf("Name() = %q, want %q", enc.Name(), CL100KBase)
+	}
+
+	// With no merges loaded, nothing ranks below any other pair, so every
+	// byte of the input stays its own token.
+	ids := enc.Encode("ab")
+	if len(ids) != 2 {
+		t.Fatalf("Encode(%q) = %v, want 2 byte-level tokens", "ab", ids)
+	}
+}
+
+func TestLoadUnknownPath(t *testing.T) {
+	if _, err := Load(CL100KBase, "/nonexistent/merges.txt"); err == nil {
+		t.Fatal("expected an error loading a nonexistent merges file")
+	}
+}
+
+func TestEncodeEmptyString(t *testing.T) {
+	enc, err := Load(CL100KBase, "")
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if ids := enc.Encode(""); ids != nil {
+		t.Errorf("Encode(%q) = %v, want nil", "", ids)
+	}
+}
+
+func TestEncodeMergesRankedPairs(t *testing.T) {
+	f := writeMergesFile(t, "ab 256\nabc 257\n")
+	enc, err := Load(CL100KBase, f)
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+
+	// "abc" should merge a+b, then ab+c, collapsing to a single token.
+	ids := enc.Encode("abc")
+	if len(ids) != 1 || ids[0] != 257 {
+		t.Errorf("Encode(%q) = %v, want [257]", "abc", ids)
+	}
+}
+
+func writeMergesFile(t *testing.T, contents string) string {
+	t.Helper()
+	f := t.TempDir() + "/merges.txt"
+	if err := os.WriteFile(f, []byte(contents), 0o600); err != nil {
+		t.Fatalf("writing merges file: %v", err)
+	}
+	return f
+}